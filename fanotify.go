@@ -3,6 +3,8 @@
 // - expanded marks
 // - added modify detection
 // - returns errors instead of panics
+// - refactored into an fsnotify-style Watcher with Add/Remove/Close, which
+//   replaces Listen along with its listenDir and isFiltered parameters
 // Must be run on Linux 5.1+
 // License: GPLv3
 
@@ -10,18 +12,54 @@ package simplefanotify
 
 import (
 	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"os"
+	"sync"
 	"syscall"
+	"time"
 	"unsafe"
 
 	"golang.org/x/sys/unix"
 )
 
+// Sentinel errors returned by NewWatcher and Add so callers can branch on
+// missing capabilities instead of parsing error strings.
+var (
+	// ErrCapSysAdmin is returned when the calling process lacks CAP_SYS_ADMIN,
+	// which fanotify requires for everything but the most limited setups.
+	ErrCapSysAdmin = errors.New("simplefanotify: CAP_SYS_ADMIN is required")
+	// ErrUnsupportedKernel is returned when the running kernel is too old for
+	// the fanotify features this package relies on (5.1+).
+	ErrUnsupportedKernel = errors.New("simplefanotify: kernel does not support the requested fanotify feature")
+	// ErrInvalidFlag is returned when a mark mask or flag combination is
+	// rejected by the kernel, or when a MarkOptions names an unknown MarkType.
+	ErrInvalidFlag = errors.New("simplefanotify: invalid mark mask or flag combination")
+	// ErrInvalidFlagCombination is returned by Add when a MarkOptions
+	// requests a combination this package rejects up front, before ever
+	// calling into the kernel.
+	ErrInvalidFlagCombination = errors.New("simplefanotify: mark type is incompatible with this Watcher's reporting mode")
+)
+
 const markFlags = unix.FAN_MARK_ADD | unix.FAN_MARK_FILESYSTEM
-const markMask = unix.FAN_ONDIR | unix.FAN_MOVED_FROM | unix.FAN_MOVED_TO | unix.FAN_CREATE | unix.FAN_DELETE | unix.FAN_MODIFY
+
+// MarkMask selects which events a watch added via Add should report. The
+// individual bits are FAN_* event flags; combine them with bitwise OR.
+type MarkMask uint64
+
+const (
+	MaskOnDir     MarkMask = unix.FAN_ONDIR
+	MaskCreate    MarkMask = unix.FAN_CREATE
+	MaskDelete    MarkMask = unix.FAN_DELETE
+	MaskModify    MarkMask = unix.FAN_MODIFY
+	MaskMovedFrom MarkMask = unix.FAN_MOVED_FROM
+	MaskMovedTo   MarkMask = unix.FAN_MOVED_TO
+
+	// DefaultMask mirrors the mask the pre-Watcher Listen function used.
+	DefaultMask = MaskOnDir | MaskMovedFrom | MaskMovedTo | MaskCreate | MaskDelete | MaskModify
+)
 
 type fanotifyInfoHeader struct {
 	infoType uint8
@@ -44,96 +82,506 @@ type fanotifyEventInfoFid struct {
 	eventFid fanotifyEventFid
 }
 
+// Event is implemented by everything delivered on Watcher.Events.
+type Event interface {
+	isEvent()
+}
+
 // All notifications, except for Modify, refer to the parent directory, not the child object.
+// Name is only populated when the Watcher negotiated FAN_REPORT_DFID_NAME;
+// see NewWatcher. Mask is populated for every event.
 type FileChange struct {
 	FolderPath string
 	ChangeType int
+
+	// Name is the child filename the event is about, resolved from the
+	// FAN_REPORT_DFID_NAME info record. Empty on kernels where the Watcher
+	// fell back to FAN_REPORT_FID.
+	Name string
+	// Mask is the raw FAN_*/IN_* event mask as reported by the kernel, so
+	// callers can tell e.g. a rename target (IN_MOVED_TO) from a fresh
+	// IN_CREATE even though both map to ChangeType Create.
+	Mask uint64
+
+	// PID, TID, UID and Exe identify the process that caused the event.
+	// PID is taken from the event metadata, or, when the Watcher negotiated
+	// FAN_REPORT_TID (which puts the thread id there, in TID instead), from
+	// the pidfd. TID, UID and Exe are only populated when the Watcher
+	// negotiated FAN_REPORT_PIDFD and FAN_REPORT_TID; see NewWatcher.
+	PID int
+	TID int
+	UID uint32
+	Exe string
 }
 
+func (FileChange) isEvent() {}
+
 const (
 	Create = iota
 	Delete
 	Modify
 )
 
-func Listen(
-	listenDir string,
-	isFiltered func(path string) bool,
-	changeReceiver chan<- FileChange,
-) error {
-	fan, err := unix.FanotifyInit(unix.FAN_REPORT_FID, 0)
+// Watcher watches one or more paths for filesystem changes and reports them
+// on Events, mirroring the shape of fsnotify.Watcher. Errors encountered
+// while reading or decoding events are reported on Errors rather than
+// dropped.
+type Watcher struct {
+	fd int
+	f  *os.File
+	r  *bufio.Reader
+
+	Events chan Event
+	Errors chan error
+
+	// reportName, reportPID and reportTID record which optional fanotify
+	// reporting features NewWatcher managed to negotiate with the kernel.
+	reportName bool
+	reportPID  bool
+	reportTID  bool
+	// pendingRename holds an unmatched FAN_MOVED_FROM FileChange while loop
+	// waits to see whether a FAN_MOVED_TO for the same move follows it.
+	pendingRename *FileChange
+
+	marks map[string]MarkOptions
+
+	// permFd, permF and permR back the second, lazily-created fanotify
+	// group used by ListenPermissions/AddPermission; see permissions.go.
+	permOnce sync.Once
+	permErr  error
+	permFd   int
+	permF    *os.File
+	permR    *bufio.Reader
+
+	// permMu guards permListening and permDone: AddPermission/RemovePermission
+	// create the permission group without ever running ListenPermissions, so
+	// Close must only wait on permDone once ListenPermissions has actually
+	// started its loop, or it would block forever.
+	permMu        sync.Mutex
+	permListening bool
+	permDone      chan struct{}
+
+	wakeR, wakeW int
+	closeOnce    sync.Once
+	closed       chan struct{}
+	done         chan struct{}
+}
+
+// NewWatcher creates a Watcher backed by a fresh fanotify group. It returns
+// ErrUnsupportedKernel if the running kernel predates 5.1, ErrCapSysAdmin if
+// the caller lacks the required capability, and a wrapped error otherwise.
+func NewWatcher() (*Watcher, error) {
+	if ok, err := kernelAtLeast(5, 1); err != nil {
+		return nil, fmt.Errorf("simplefanotify: checking kernel version: %w", err)
+	} else if !ok {
+		return nil, ErrUnsupportedKernel
+	}
+
+	// Negotiate the richest event reporting the kernel accepts, falling back
+	// a step at a time: FAN_REPORT_PIDFD/FAN_REPORT_TID need 5.15+, and
+	// FAN_REPORT_DFID_NAME needs 5.9+; FAN_REPORT_FID alone works back to 5.1.
+	attempts := []struct {
+		flags                            uint
+		reportName, reportPID, reportTID bool
+	}{
+		{unix.FAN_REPORT_DFID_NAME | unix.FAN_REPORT_PIDFD | unix.FAN_REPORT_TID, true, true, true},
+		{unix.FAN_REPORT_DFID_NAME, true, false, false},
+		{unix.FAN_REPORT_FID, false, false, false},
+	}
+
+	var fd int
+	var err error
+	chosen := attempts[len(attempts)-1]
+	for _, attempt := range attempts {
+		fd, err = unix.FanotifyInit(attempt.flags, 0)
+		if err == nil {
+			chosen = attempt
+			break
+		}
+		if err != unix.EINVAL {
+			break // a real error, not just an unsupported flag combination
+		}
+	}
 	if err != nil {
-		return fmt.Errorf("fanotifyinit: %v", err)
+		switch err {
+		case unix.EPERM:
+			return nil, ErrCapSysAdmin
+		case unix.ENOSYS, unix.EINVAL:
+			return nil, ErrUnsupportedKernel
+		}
+		return nil, fmt.Errorf("simplefanotify: fanotify_init: %w", err)
 	}
 
-	err = unix.FanotifyMark(fan, markFlags, markMask, unix.AT_FDCWD, listenDir)
+	fds := make([]int, 2)
+	if err := unix.Pipe(fds); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("simplefanotify: pipe: %w", err)
+	}
 
+	f := os.NewFile(uintptr(fd), "fanotify")
+	w := &Watcher{
+		fd:         fd,
+		f:          f,
+		r:          bufio.NewReader(f),
+		reportName: chosen.reportName,
+		reportPID:  chosen.reportPID,
+		reportTID:  chosen.reportTID,
+		Events:     make(chan Event),
+		Errors:     make(chan error),
+		marks:      make(map[string]MarkOptions),
+		wakeR:      fds[0],
+		wakeW:      fds[1],
+		closed:     make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+
+	go w.loop()
+	return w, nil
+}
+
+// Add starts watching path with the scope and events selected by opts.
+func (w *Watcher) Add(path string, opts MarkOptions) error {
+	typeFlags, err := w.markTypeFlags(opts.Type)
 	if err != nil {
-		return fmt.Errorf("fanotifymark: %v", err)
+		return err
+	}
+	flags := unix.FAN_MARK_ADD | typeFlags
+	if err := unix.FanotifyMark(w.fd, flags, uint64(opts.Mask), unix.AT_FDCWD, path); err != nil {
+		if err == unix.EINVAL {
+			return ErrInvalidFlag
+		}
+		return fmt.Errorf("simplefanotify: fanotify_mark add %s: %w", path, err)
+	}
+	w.marks[path] = opts
+	return nil
+}
+
+// ReportsName reports whether events populate FileChange.Name, i.e. whether
+// NewWatcher managed to negotiate FAN_REPORT_DFID_NAME.
+func (w *Watcher) ReportsName() bool { return w.reportName }
+
+// ReportsProcess reports whether events populate FileChange.TID, UID and
+// Exe, i.e. whether NewWatcher managed to negotiate FAN_REPORT_PIDFD.
+// FileChange.PID is populated either way.
+func (w *Watcher) ReportsProcess() bool { return w.reportPID }
+
+// Remove stops watching path.
+func (w *Watcher) Remove(path string) error {
+	opts, ok := w.marks[path]
+	if !ok {
+		return fmt.Errorf("simplefanotify: %s is not watched", path)
+	}
+	typeFlags, err := w.markTypeFlags(opts.Type)
+	if err != nil {
+		return err
+	}
+	flags := unix.FAN_MARK_REMOVE | typeFlags
+	if err := unix.FanotifyMark(w.fd, flags, uint64(opts.Mask), unix.AT_FDCWD, path); err != nil {
+		if err == unix.EINVAL {
+			return ErrInvalidFlag
+		}
+		return fmt.Errorf("simplefanotify: fanotify_mark remove %s: %w", path, err)
 	}
+	delete(w.marks, path)
+	return nil
+}
+
+// MarkType selects the scope a watch added via Add covers.
+type MarkType int
+
+const (
+	// MarkMount watches a single mount point (FAN_MARK_MOUNT).
+	//
+	// It cannot currently be used with this Watcher: NewWatcher always
+	// negotiates FID-based event reporting (at minimum FAN_REPORT_FID), and
+	// the kernel rejects FAN_MARK_MOUNT in combination with FID reporting.
+	// Add always returns ErrInvalidFlagCombination for it; it is kept as a
+	// MarkType for when a non-FID reporting mode is supported.
+	MarkMount MarkType = iota
+	// MarkFilesystem watches an entire filesystem (FAN_MARK_FILESYSTEM), as
+	// the pre-Watcher Listen function always did.
+	MarkFilesystem
+	// MarkInode watches a single file or directory.
+	MarkInode
+)
+
+// MarkOptions configures a call to Add: the scope to mark (Type) and which
+// events within that scope to report (Mask).
+type MarkOptions struct {
+	Type MarkType
+	Mask MarkMask
+}
+
+// markTypeFlags maps a MarkType to its FAN_MARK_* flag and validates it
+// against the reporting features this Watcher's group negotiated.
+func (w *Watcher) markTypeFlags(t MarkType) (uint, error) {
+	switch t {
+	case MarkMount:
+		// FAN_MARK_MOUNT cannot be combined with FID-based event reporting,
+		// which NewWatcher always requests (at minimum FAN_REPORT_FID) so
+		// that events can be resolved to a path.
+		return 0, ErrInvalidFlagCombination
+	case MarkFilesystem:
+		return unix.FAN_MARK_FILESYSTEM, nil
+	case MarkInode:
+		return 0, nil
+	default:
+		return 0, ErrInvalidFlag
+	}
+}
+
+// Close stops the reader loop, releases the fanotify fd, and closes Events
+// and Errors. It is safe to call Close more than once.
+func (w *Watcher) Close() error {
+	var err error
+	w.closeOnce.Do(func() {
+		close(w.closed)
+		// Wake the poll loop out of its blocking wait.
+		unix.Write(w.wakeW, []byte{0})
+		<-w.done
+		unix.Close(w.wakeR)
+		unix.Close(w.wakeW)
+		err = w.f.Close()
+		if w.permF != nil {
+			w.permMu.Lock()
+			listening, done := w.permListening, w.permDone
+			w.permMu.Unlock()
+			if listening {
+				<-done
+			}
+			if permErr := w.permF.Close(); err == nil {
+				err = permErr
+			}
+		}
+		close(w.Events)
+		close(w.Errors)
+	})
+	return err
+}
 
-	f := os.NewFile(uintptr(fan), "")
-	r := bufio.NewReader(f)
+// renameCorrelationWindow bounds how long a FAN_MOVED_FROM waits in
+// pendingRename for a matching FAN_MOVED_TO before loop gives up and
+// delivers it on its own. Without this, a move out of the watched tree
+// during a quiet period would sit buffered indefinitely, since nothing
+// else would ever arrive to flush it.
+const renameCorrelationWindow = 10 * time.Millisecond
+
+// loop reads events from the fanotify fd until Close wakes it via wakeR.
+func (w *Watcher) loop() {
+	defer close(w.done)
+
+	pollFds := []unix.PollFd{
+		{Fd: int32(w.fd), Events: unix.POLLIN},
+		{Fd: int32(w.wakeR), Events: unix.POLLIN},
+	}
 
 	for {
-		readEvent(r, isFiltered, changeReceiver)
+		// bufio may already be holding a complete event read from a
+		// previous, larger read(); only block in poll once it's drained.
+		if w.r.Buffered() == 0 {
+			timeout := -1
+			if w.pendingRename != nil {
+				timeout = int(renameCorrelationWindow / time.Millisecond)
+			}
+			n, err := unix.Poll(pollFds, timeout)
+			if err != nil {
+				if err == unix.EINTR {
+					continue
+				}
+				w.sendErr(fmt.Errorf("simplefanotify: poll: %w", err))
+				return
+			}
+			if n == 0 {
+				// renameCorrelationWindow elapsed with nothing to pair the
+				// pending FAN_MOVED_FROM against; surface it now.
+				for _, ev := range w.flushPendingRename() {
+					select {
+					case w.Events <- ev:
+					case <-w.closed:
+						return
+					}
+				}
+				continue
+			}
+			if pollFds[1].Revents&unix.POLLIN != 0 {
+				return
+			}
+			if pollFds[0].Revents&unix.POLLIN == 0 {
+				continue
+			}
+		}
+
+		change, err := w.readEvent()
+		if err != nil {
+			if !w.sendErr(err) {
+				return
+			}
+			continue
+		}
+		if change == nil {
+			continue
+		}
+
+		for _, ev := range w.correlateRename(*change) {
+			select {
+			case w.Events <- ev:
+			case <-w.closed:
+				return
+			}
+		}
 	}
 }
 
-var metaBuff = make([]byte, 24)
+// correlateRename pairs a FAN_MOVED_FROM FileChange with the FAN_MOVED_TO
+// that immediately follows it in the same directory into a single Rename,
+// so callers see one move instead of a delete-then-create. It returns the
+// events (zero, one or two) that loop should now emit.
+//
+// fanotify's event metadata carries no rename cookie (unlike inotify), so
+// there is no way to truly correlate a FAN_MOVED_FROM with its FAN_MOVED_TO;
+// this is a best-effort heuristic, not a guarantee. It only fuses the two
+// when they are back-to-back *and* share FolderPath, to cut down on (without
+// fully eliminating) mis-pairing, e.g. an unrelated FAN_MOVED_TO for a file
+// moved in from elsewhere right after a FAN_MOVED_FROM for a file moved out.
+// Even then, the resulting Rename.From.Name and .To.Name are not verified to
+// refer to the same file — they may legitimately name two different files
+// that both moved within the same directory back-to-back.
+func (w *Watcher) correlateRename(fc FileChange) []Event {
+	switch {
+	case fc.Mask&unix.IN_MOVED_FROM != 0:
+		flushed := w.flushPendingRename()
+		w.pendingRename = &fc
+		return flushed
 
-func readEvent(r io.Reader, isFiltered func(path string) bool, changeReceiver chan<- FileChange) error {
-	_, err := r.Read(metaBuff)
-	if err != nil {
-		return fmt.Errorf("reading meta: %v", err)
+	case fc.Mask&unix.IN_MOVED_TO != 0 && w.pendingRename != nil && w.pendingRename.FolderPath == fc.FolderPath:
+		rename := Rename{From: *w.pendingRename, To: fc}
+		w.pendingRename = nil
+		return []Event{rename}
+
+	default:
+		return append(w.flushPendingRename(), fc)
+	}
+}
+
+// flushPendingRename returns the unmatched FAN_MOVED_FROM, if any, as a
+// standalone event and clears it.
+func (w *Watcher) flushPendingRename() []Event {
+	if w.pendingRename == nil {
+		return nil
+	}
+	flushed := []Event{*w.pendingRename}
+	w.pendingRename = nil
+	return flushed
+}
+
+// sendErr delivers err on Errors, returning false if the Watcher was closed
+// in the meantime so the caller can stop.
+func (w *Watcher) sendErr(err error) bool {
+	select {
+	case w.Errors <- err:
+		return true
+	case <-w.closed:
+		return false
+	}
+}
+
+// fanotifyMetadataLen is sizeof(struct fanotify_event_metadata).
+const fanotifyMetadataLen = 24
+
+// fanotify_event_info_header.info_type values this package understands.
+// FID carries only a parent directory fid; DFIDName additionally appends the
+// child's null-terminated filename after the file handle; PIDFD carries a
+// file descriptor referring to the process that caused the event.
+const (
+	fanEventInfoTypeFID      = 1
+	fanEventInfoTypeDFIDName = 2
+	fanEventInfoTypePIDFD    = 4
+)
+
+type fanotifyEventInfoPidfd struct {
+	hdr   fanotifyInfoHeader
+	pidfd int32
+}
+
+// readEvent reads and decodes one fanotify event. It returns a nil
+// FileChange (and nil error) if the event carried no FID/DFIDName info
+// record this package can resolve a path from.
+func (w *Watcher) readEvent() (*FileChange, error) {
+	metaBuff := make([]byte, fanotifyMetadataLen)
+	if _, err := io.ReadFull(w.r, metaBuff); err != nil {
+		return nil, fmt.Errorf("simplefanotify: reading meta: %w", err)
 	}
 
 	meta := *((*unix.FanotifyEventMetadata)(unsafe.Pointer(&metaBuff[0])))
 	bytesLeft := int(meta.Event_len - uint32(meta.Metadata_len))
 	infoBuff := make([]byte, bytesLeft)
-	n, err := r.Read(infoBuff)
-	if err != nil {
-		return fmt.Errorf("reading info: %v", err)
+	if _, err := io.ReadFull(w.r, infoBuff); err != nil {
+		return nil, fmt.Errorf("simplefanotify: reading info: %w", err)
 	}
 
-	if n < 0 || n > bytesLeft {
-		return fmt.Errorf("reading infoBuff gave back strange number of bytes")
-	}
+	// The kernel concatenates one info record per negotiated reporting
+	// feature (FID/DFIDName, PIDFD, ...); walk them using each record's own
+	// header.Len rather than assuming a single record fills infoBuff.
+	var fidInfo *fanotifyEventInfoFid
+	var fidRec []byte // the FID/DFIDName record's own bytes, for handle/name slicing below
+	var name string
+	pidfd := int32(-1)
+	for offset := 0; offset < len(infoBuff); {
+		hdr := *(*fanotifyInfoHeader)(unsafe.Pointer(&infoBuff[offset]))
+		recLen := int(hdr.Len)
+		if recLen <= 0 || offset+recLen > len(infoBuff) {
+			break // malformed or truncated; stop rather than read out of bounds
+		}
+		rec := infoBuff[offset : offset+recLen]
 
-	info := *((*fanotifyEventInfoFid)(unsafe.Pointer(&infoBuff[0])))
+		switch hdr.infoType {
+		case fanEventInfoTypeFID, fanEventInfoTypeDFIDName:
+			info := *(*fanotifyEventInfoFid)(unsafe.Pointer(&rec[0]))
+			fidInfo = &info
+			fidRec = rec
+			if hdr.infoType == fanEventInfoTypeDFIDName {
+				handleStart := int(unsafe.Sizeof(info))
+				nameBytes := rec[handleStart+int(info.eventFid.fileHandle.handleBytes):]
+				if nul := bytes.IndexByte(nameBytes, 0); nul >= 0 {
+					nameBytes = nameBytes[:nul]
+				}
+				name = string(nameBytes)
+			}
+		case fanEventInfoTypePIDFD:
+			info := *(*fanotifyEventInfoPidfd)(unsafe.Pointer(&rec[0]))
+			pidfd = info.pidfd
+		}
 
-	if info.hdr.infoType != 1 {
-		return nil
+		offset += recLen
+	}
+
+	if fidInfo == nil {
+		// No FID/DFIDName record to resolve a path from, so this event is
+		// otherwise unusable; still close pidfd, since nothing else will.
+		if pidfd >= 0 {
+			unix.Close(int(pidfd))
+		}
+		return nil, nil
 	}
 
-	handleStart := uint32(unsafe.Sizeof(info))
-	handleLen := info.eventFid.fileHandle.handleBytes
-	handleBytes := infoBuff[handleStart : handleStart+handleLen]
-	unixFileHandle := unix.NewFileHandle(info.eventFid.fileHandle.handleType, handleBytes)
+	handleStart := uint32(unsafe.Sizeof(*fidInfo))
+	handleLen := fidInfo.eventFid.fileHandle.handleBytes
+	handleBytes := fidRec[handleStart : handleStart+handleLen]
+	unixFileHandle := unix.NewFileHandle(fidInfo.eventFid.fileHandle.handleType, handleBytes)
 
 	fd, err := unix.OpenByHandleAt(unix.AT_FDCWD, unixFileHandle, 0)
 	if err != nil {
-		return fmt.Errorf("could not call OpenByHandleAt: %v", err)
+		return nil, fmt.Errorf("simplefanotify: open_by_handle_at: %w", err)
 	}
-
-	defer func() {
-		err = syscall.Close(fd)
-		if err != nil {
-			log.Println("warning: couldn't close file descriptor", err)
-		}
-	}()
+	defer syscall.Close(fd)
 
 	sym := fmt.Sprintf("/proc/self/fd/%d", fd)
 	path := make([]byte, 200)
 	pathLength, err := unix.Readlink(sym, path)
-
 	if err != nil {
-		return fmt.Errorf("could not call Readlink: %v", err)
+		return nil, fmt.Errorf("simplefanotify: readlink: %w", err)
 	}
 	path = path[:pathLength]
-	if isFiltered(string(path)) {
-		return nil
-	}
 
 	changeType := 0
 	if meta.Mask&unix.IN_CREATE > 0 ||
@@ -148,11 +596,59 @@ func readEvent(r io.Reader, isFiltered func(path string) bool, changeReceiver ch
 		changeType = Modify
 	}
 
-	change := FileChange{
-		string(path),
-		changeType,
+	change := &FileChange{
+		FolderPath: string(path),
+		ChangeType: changeType,
+		Name:       name,
+		Mask:       meta.Mask,
 	}
 
-	changeReceiver <- change
-	return nil
+	if w.reportTID {
+		change.TID = int(meta.Pid)
+	} else {
+		change.PID = int(meta.Pid)
+	}
+	if pidfd >= 0 {
+		pid, uid, exe, err := resolvePidfd(pidfd)
+		if err != nil {
+			w.sendErr(fmt.Errorf("simplefanotify: resolving pidfd: %w", err))
+		} else {
+			if change.PID == 0 {
+				change.PID = pid
+			}
+			change.UID = uid
+			change.Exe = exe
+		}
+	}
+
+	return change, nil
+}
+
+// kernelAtLeast reports whether the running kernel's release version is at
+// least major.minor.
+func kernelAtLeast(major, minor int) (bool, error) {
+	var uname unix.Utsname
+	if err := unix.Uname(&uname); err != nil {
+		return false, fmt.Errorf("uname: %w", err)
+	}
+
+	release := charsToString(uname.Release[:])
+	var gotMajor, gotMinor int
+	if _, err := fmt.Sscanf(release, "%d.%d", &gotMajor, &gotMinor); err != nil {
+		return false, fmt.Errorf("parsing kernel release %q: %w", release, err)
+	}
+
+	if gotMajor != major {
+		return gotMajor > major, nil
+	}
+	return gotMinor >= minor, nil
+}
+
+func charsToString(ca []byte) string {
+	for i, c := range ca {
+		if c == 0 {
+			return string(ca[:i])
+		}
+	}
+	return string(ca)
 }
@@ -0,0 +1,214 @@
+package simplefanotify
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Decision is the verdict a ListenPermissions handler returns to the kernel
+// for a pending open/access/exec.
+type Decision int
+
+const (
+	Allow Decision = iota
+	Deny
+)
+
+// PermissionEvent describes a pending open/access/exec that is blocked on a
+// Decision from the handler passed to ListenPermissions.
+type PermissionEvent struct {
+	Path string
+	PID  int
+}
+
+// fanotifyResponse mirrors struct fanotify_response from linux/fanotify.h.
+type fanotifyResponse struct {
+	Fd       int32
+	Response uint32
+}
+
+// permissionTimeout bounds how long a handler may take to decide. A
+// requesting process is blocked the whole time it waits on a decision, so a
+// handler that never responds would otherwise wedge that process forever.
+const permissionTimeout = 5 * time.Second
+
+// permGroupFlags inits a *separate* fanotify group dedicated to permission
+// events: FAN_REPORT_FID, used by the notification group NewWatcher creates,
+// cannot be combined with FAN_CLASS_CONTENT/FAN_CLASS_PRE_CONTENT. Permission
+// events from this group carry a real, already-open file descriptor in
+// place of a FID.
+const permGroupFlags = unix.FAN_CLASS_CONTENT
+
+// AddPermission marks path so that the events selected by mask (FAN_OPEN_PERM,
+// FAN_ACCESS_PERM, or FAN_OPEN_EXEC_PERM) are decided by the handler passed
+// to ListenPermissions instead of being delivered on Events.
+func (w *Watcher) AddPermission(path string, mask MarkMask) error {
+	if err := w.ensurePermGroup(); err != nil {
+		return err
+	}
+	if err := unix.FanotifyMark(w.permFd, markFlags, uint64(mask), unix.AT_FDCWD, path); err != nil {
+		if err == unix.EINVAL {
+			return ErrInvalidFlag
+		}
+		return fmt.Errorf("simplefanotify: fanotify_mark add permission %s: %w", path, err)
+	}
+	return nil
+}
+
+// RemovePermission stops routing events for path to the permission handler.
+func (w *Watcher) RemovePermission(path string, mask MarkMask) error {
+	if err := w.ensurePermGroup(); err != nil {
+		return err
+	}
+	flags := uint(unix.FAN_MARK_REMOVE | unix.FAN_MARK_FILESYSTEM)
+	if err := unix.FanotifyMark(w.permFd, flags, uint64(mask), unix.AT_FDCWD, path); err != nil {
+		if err == unix.EINVAL {
+			return ErrInvalidFlag
+		}
+		return fmt.Errorf("simplefanotify: fanotify_mark remove permission %s: %w", path, err)
+	}
+	return nil
+}
+
+func (w *Watcher) ensurePermGroup() error {
+	w.permOnce.Do(func() {
+		fd, err := unix.FanotifyInit(permGroupFlags, unix.O_RDWR)
+		if err != nil {
+			if err == unix.EPERM {
+				w.permErr = ErrCapSysAdmin
+			} else {
+				w.permErr = fmt.Errorf("simplefanotify: fanotify_init (permissions): %w", err)
+			}
+			return
+		}
+		w.permFd = fd
+		w.permF = os.NewFile(uintptr(fd), "fanotify-perm")
+		w.permR = bufio.NewReader(w.permF)
+	})
+	return w.permErr
+}
+
+// ListenPermissions routes permission events marked via AddPermission to
+// handler and writes its Decision back to the kernel, allowing the access if
+// handler has not decided within permissionTimeout. It blocks until the
+// Watcher is closed, so call it from
+// its own goroutine, mirroring how the pre-Watcher Listen function blocked.
+func (w *Watcher) ListenPermissions(handler func(PermissionEvent) Decision) error {
+	if err := w.ensurePermGroup(); err != nil {
+		return err
+	}
+
+	w.permMu.Lock()
+	if w.permListening {
+		w.permMu.Unlock()
+		return fmt.Errorf("simplefanotify: ListenPermissions is already running")
+	}
+	w.permListening = true
+	w.permDone = make(chan struct{})
+	done := w.permDone
+	w.permMu.Unlock()
+	defer close(done)
+
+	pollFds := []unix.PollFd{
+		{Fd: int32(w.permFd), Events: unix.POLLIN},
+		{Fd: int32(w.wakeR), Events: unix.POLLIN},
+	}
+
+	for {
+		if w.permR.Buffered() == 0 {
+			if _, err := unix.Poll(pollFds, -1); err != nil {
+				if err == unix.EINTR {
+					continue
+				}
+				w.sendErr(fmt.Errorf("simplefanotify: poll (permissions): %w", err))
+				return nil
+			}
+			if pollFds[1].Revents&unix.POLLIN != 0 {
+				return nil
+			}
+			if pollFds[0].Revents&unix.POLLIN == 0 {
+				continue
+			}
+		}
+
+		fd, path, pid, err := w.readPermissionEvent()
+		if err != nil {
+			if !w.sendErr(err) {
+				return nil
+			}
+			continue
+		}
+
+		go w.decidePermission(fd, path, pid, handler)
+	}
+}
+
+// decidePermission calls handler with a deadline and writes its Decision
+// back to the kernel, auto-allowing if the handler is too slow. fd is
+// always closed, since it is the caller's only open reference to it.
+func (w *Watcher) decidePermission(fd int32, path string, pid int, handler func(PermissionEvent) Decision) {
+	defer unix.Close(int(fd))
+
+	decided := make(chan Decision, 1)
+	go func() {
+		decided <- handler(PermissionEvent{Path: path, PID: pid})
+	}()
+
+	var decision Decision // zero value Allow: auto-allow on timeout
+	select {
+	case decision = <-decided:
+	case <-time.After(permissionTimeout):
+	}
+
+	w.respond(fd, decision)
+}
+
+// respond writes decision back to the kernel for the pending event fd, so
+// the process it blocked can proceed. It must be called for every fd handed
+// out by readPermissionEvent, even on error paths below it: fanotify has no
+// kernel-side timeout for FAN_OPEN_PERM/FAN_ACCESS_PERM/FAN_OPEN_EXEC_PERM,
+// so a pending event that never gets a response wedges that process forever.
+func (w *Watcher) respond(fd int32, decision Decision) {
+	resp := fanotifyResponse{Fd: fd, Response: uint32(unix.FAN_ALLOW)}
+	if decision == Deny {
+		resp.Response = uint32(unix.FAN_DENY)
+	}
+
+	respBuff := (*[unsafe.Sizeof(resp)]byte)(unsafe.Pointer(&resp))[:]
+	if _, err := w.permF.Write(respBuff); err != nil {
+		w.sendErr(fmt.Errorf("simplefanotify: writing fanotify_response: %w", err))
+	}
+}
+
+func (w *Watcher) readPermissionEvent() (int32, string, int, error) {
+	metaBuff := make([]byte, fanotifyMetadataLen)
+	if _, err := io.ReadFull(w.permR, metaBuff); err != nil {
+		return 0, "", 0, fmt.Errorf("simplefanotify: reading permission meta: %w", err)
+	}
+	meta := *((*unix.FanotifyEventMetadata)(unsafe.Pointer(&metaBuff[0])))
+
+	if extra := int(meta.Event_len) - int(meta.Metadata_len); extra > 0 {
+		if _, err := io.CopyN(io.Discard, w.permR, int64(extra)); err != nil {
+			return 0, "", 0, fmt.Errorf("simplefanotify: discarding permission info: %w", err)
+		}
+	}
+
+	sym := fmt.Sprintf("/proc/self/fd/%d", meta.Fd)
+	path := make([]byte, 200)
+	n, err := unix.Readlink(sym, path)
+	if err != nil {
+		// Closing meta.Fd alone does not release the kernel: respond before
+		// returning, or the process behind this event blocks forever.
+		w.respond(meta.Fd, Allow)
+		unix.Close(int(meta.Fd))
+		return 0, "", 0, fmt.Errorf("simplefanotify: readlink: %w", err)
+	}
+
+	return meta.Fd, string(path[:n]), int(meta.Pid), nil
+}
@@ -0,0 +1,63 @@
+package simplefanotify
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// resolvePidfd reads the real PID, UID and executable path of the process
+// referred to by pidfd, then closes it. stat(2) on a pidfd reports the real
+// UID/GID of the target process (see pidfd_open(2)); the PID itself has to
+// be recovered from /proc/self/fdinfo since no syscall returns it directly.
+func resolvePidfd(pidfd int32) (pid int, uid uint32, exe string, err error) {
+	fd := int(pidfd)
+	defer unix.Close(fd)
+
+	var stat unix.Stat_t
+	if err = unix.Fstat(fd, &stat); err != nil {
+		return 0, 0, "", fmt.Errorf("fstat pidfd: %w", err)
+	}
+	uid = stat.Uid
+
+	pid, err = pidfdPid(fd)
+	if err != nil {
+		return 0, uid, "", err
+	}
+
+	exe, err = os.Readlink(fmt.Sprintf("/proc/%d/exe", pid))
+	if err != nil {
+		return pid, uid, "", fmt.Errorf("readlink exe: %w", err)
+	}
+	return pid, uid, exe, nil
+}
+
+// pidfdPid extracts the "Pid:" field from /proc/self/fdinfo/<pidfd>, the
+// documented way to recover a pid from a pidfd (see proc(5)).
+func pidfdPid(pidfd int) (int, error) {
+	f, err := os.Open(fmt.Sprintf("/proc/self/fdinfo/%d", pidfd))
+	if err != nil {
+		return 0, fmt.Errorf("open fdinfo: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "Pid:") {
+			pid, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "Pid:")))
+			if err != nil {
+				return 0, fmt.Errorf("parsing fdinfo Pid line %q: %w", line, err)
+			}
+			return pid, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, fmt.Errorf("scanning fdinfo: %w", err)
+	}
+	return 0, fmt.Errorf("fdinfo has no Pid line")
+}
@@ -0,0 +1,16 @@
+package simplefanotify
+
+// Rename is delivered on Watcher.Events in place of a separate Delete and
+// Create when a FAN_MOVED_FROM is immediately followed by a FAN_MOVED_TO in
+// the same directory. This is a heuristic, not a guarantee: fanotify has no
+// rename cookie to correlate the two by, so it is possible (if unlikely) for
+// an unrelated move into the same directory to be mis-paired; see
+// (*Watcher).correlateRename. When that happens, From.Name and To.Name are
+// not verified to refer to the same file — callers that need certainty
+// should compare them rather than treat the pairing as authoritative.
+type Rename struct {
+	From FileChange
+	To   FileChange
+}
+
+func (Rename) isEvent() {}